@@ -0,0 +1,120 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"k8s.io/ingress-gce/pkg/ratelimit"
+)
+
+// ratelimitValidateOptions holds the flags accepted by "mci ratelimit validate".
+type ratelimitValidateOptions struct {
+	// SpecsFile is the path to a file with one rate limit spec per line.
+	// Mutually exclusive with Specs.
+	SpecsFile string
+	// Specs is the list of rate limit specs to validate, passed directly
+	// via repeated --spec flags. Mutually exclusive with SpecsFile.
+	Specs []string
+}
+
+// NewCmdRatelimitValidate returns the "mci ratelimit validate" command. It
+// parses rate limit specs from a file or --spec flags and prints a table of
+// which ones are valid, so operators can iterate on a config offline
+// before pushing it to the controller.
+func NewCmdRatelimitValidate(out io.Writer) *cobra.Command {
+	var options ratelimitValidateOptions
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate GCE rate limit specs",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateRatelimitValidateArgs(&options, args); err != nil {
+				return err
+			}
+			specs, err := loadRatelimitSpecs(&options)
+			if err != nil {
+				return err
+			}
+			printRatelimitValidation(out, specs, ratelimit.Validate(specs))
+			return nil
+		},
+	}
+	addRatelimitValidateFlags(cmd, &options)
+	return cmd
+}
+
+func addRatelimitValidateFlags(cmd *cobra.Command, options *ratelimitValidateOptions) {
+	cmd.Flags().StringVarP(&options.SpecsFile, "specs-file", "", "", "Path to a file containing one rate limit spec per line")
+	cmd.Flags().StringArrayVarP(&options.Specs, "spec", "", nil, "A rate limit spec to validate; may be repeated")
+}
+
+// validateRatelimitValidateArgs checks that options describes exactly one
+// source of specs to validate.
+func validateRatelimitValidateArgs(options *ratelimitValidateOptions, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("Unexpected arguments: %v", args)
+	}
+	if options.SpecsFile == "" && len(options.Specs) == 0 {
+		return fmt.Errorf("Must specify one of --specs-file or --spec")
+	}
+	if options.SpecsFile != "" && len(options.Specs) != 0 {
+		return fmt.Errorf("Must specify only one of --specs-file or --spec, not both")
+	}
+	return nil
+}
+
+// loadRatelimitSpecs returns the specs to validate: either the ones passed
+// directly via --spec, or the non-empty lines of --specs-file.
+func loadRatelimitSpecs(options *ratelimitValidateOptions) ([]string, error) {
+	if len(options.Specs) != 0 {
+		return options.Specs, nil
+	}
+	f, err := os.Open(options.SpecsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %v: %v", options.SpecsFile, err)
+	}
+	defer f.Close()
+	var specs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			specs = append(specs, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading %v: %v", options.SpecsFile, err)
+	}
+	return specs, nil
+}
+
+// printRatelimitValidation prints a table of specs and, for any which
+// failed to parse, the resulting error.
+func printRatelimitValidation(out io.Writer, specs []string, errs []error) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SPEC\tVALID\tERROR")
+	for i, spec := range specs {
+		if errs[i] == nil {
+			fmt.Fprintf(w, "%v\ttrue\t\n", spec)
+		} else {
+			fmt.Fprintf(w, "%v\tfalse\t%v\n", spec, errs[i])
+		}
+	}
+	w.Flush()
+}
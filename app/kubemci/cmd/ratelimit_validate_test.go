@@ -0,0 +1,52 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+)
+
+func TestValidateRatelimitValidateArgs(t *testing.T) {
+	// It should return an error with extra args.
+	if err := validateRatelimitValidateArgs(&ratelimitValidateOptions{Specs: []string{"ga.Addresses.Get,qps,1.5,5"}}, []string{"arg1"}); err == nil {
+		t.Errorf("Expected error for non-empty args")
+	}
+
+	// It should return an error when neither --specs-file nor --spec is given.
+	if err := validateRatelimitValidateArgs(&ratelimitValidateOptions{}, []string{}); err == nil {
+		t.Errorf("Expected error when neither --specs-file nor --spec is given")
+	}
+
+	// It should return an error when both --specs-file and --spec are given.
+	options := ratelimitValidateOptions{
+		SpecsFile: "specs.txt",
+		Specs:     []string{"ga.Addresses.Get,qps,1.5,5"},
+	}
+	if err := validateRatelimitValidateArgs(&options, []string{}); err == nil {
+		t.Errorf("Expected error when both --specs-file and --spec are given")
+	}
+
+	// It should succeed with just --spec.
+	options = ratelimitValidateOptions{Specs: []string{"ga.Addresses.Get,qps,1.5,5"}}
+	if err := validateRatelimitValidateArgs(&options, []string{}); err != nil {
+		t.Errorf("unexpected error from validateRatelimitValidateArgs: %s", err)
+	}
+
+	// It should succeed with just --specs-file.
+	options = ratelimitValidateOptions{SpecsFile: "specs.txt"}
+	if err := validateRatelimitValidateArgs(&options, []string{}); err != nil {
+		t.Errorf("unexpected error from validateRatelimitValidateArgs: %s", err)
+	}
+}
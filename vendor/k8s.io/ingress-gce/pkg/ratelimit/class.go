@@ -0,0 +1,268 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/kubernetes/pkg/cloudprovider/providers/gce/cloud"
+)
+
+// RequestClass classifies the caller of Accept, so a GCERateLimiter with
+// per-class buckets configured (spec grammar "...,qps,1.5,5,class=reconcile")
+// can prioritize interactive work over background sync loops contending for
+// the same GCE operation's quota. Attach a class to a context with
+// WithClass before calling Accept.
+type RequestClass string
+
+const (
+	// ClassInteractive is for calls made in direct response to a user
+	// action, e.g. handling a freshly created Ingress.
+	ClassInteractive RequestClass = "interactive"
+	// ClassReconcile is for calls made by the controller's steady-state
+	// reconcile loop.
+	ClassReconcile RequestClass = "reconcile"
+	// ClassBackground is for calls made by periodic housekeeping, e.g. GC.
+	ClassBackground RequestClass = "background"
+)
+
+// classPriority orders classes from highest priority (lowest number) to
+// lowest. It also serves as the set of valid class names accepted by a
+// class= spec modifier.
+var classPriority = map[RequestClass]int{
+	ClassInteractive: 0,
+	ClassReconcile:   1,
+	ClassBackground:  2,
+}
+
+type classContextKey struct{}
+
+// WithClass returns a copy of ctx carrying class, for a GCERateLimiter with
+// per-class buckets to consult in Accept.
+func WithClass(ctx context.Context, class RequestClass) context.Context {
+	return context.WithValue(ctx, classContextKey{}, class)
+}
+
+// classFromContext returns the RequestClass attached to ctx by WithClass,
+// or ClassBackground if none was attached.
+func classFromContext(ctx context.Context) RequestClass {
+	if class, ok := ctx.Value(classContextKey{}).(RequestClass); ok {
+		return class
+	}
+	return ClassBackground
+}
+
+// classRateLimiter maintains one token bucket per RequestClass for a
+// single GCE operation. When the bucket for the calling context's class is
+// empty, it may borrow a token from a lower-priority class's bucket, up to
+// the calling class's own borrowCeiling tokens over the lifetime of the limiter
+// per (borrower, lender) pair, so that e.g. an interactive ingress
+// reconcile is not starved by a background sync loop that still has
+// budget of its own.
+type classRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[RequestClass]flowcontrol.RateLimiter
+	// borrowCeilings[borrower] is the borrow ceiling from that class's own
+	// spec, independent of the order specs for this key were parsed in.
+	borrowCeilings map[RequestClass]int
+	// borrowed[borrower][lender] counts tokens borrower has already taken
+	// from lender's bucket, capped at borrowCeilings[borrower].
+	borrowed map[RequestClass]map[RequestClass]int
+}
+
+func newClassRateLimiter() *classRateLimiter {
+	return &classRateLimiter{
+		buckets:        make(map[RequestClass]flowcontrol.RateLimiter),
+		borrowCeilings: make(map[RequestClass]int),
+		borrowed:       make(map[RequestClass]map[RequestClass]int),
+	}
+}
+
+// setClass configures the token bucket used for class, and the ceiling on
+// how many tokens class may borrow from each lower-priority class.
+func (c *classRateLimiter) setClass(class RequestClass, qps float32, burst int, borrowCeiling int) error {
+	if _, ok := classPriority[class]; !ok {
+		return fmt.Errorf("Unknown request class: %v", class)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buckets[class] = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	c.borrowCeilings[class] = borrowCeiling
+	return nil
+}
+
+// Accept implements rateLimiterImpl.
+func (c *classRateLimiter) Accept(ctx context.Context, key *cloud.RateLimitKey) {
+	class := classFromContext(ctx)
+	c.mu.Lock()
+	bucket, ok := c.buckets[class]
+	if !ok {
+		// No bucket configured for this class; fall back to treating it
+		// as the lowest priority so it is still gated by something.
+		bucket, ok = c.lowestPriorityBucketLocked()
+	}
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	if bucket.TryAccept() {
+		c.mu.Unlock()
+		return
+	}
+	if lender, _, ok := c.borrowableBucketLocked(class); ok {
+		// borrowableBucketLocked already consumed a token from the
+		// lender's bucket via TryAccept; calling Accept on it again
+		// here would take a second token and block on the lender's
+		// refill interval, defeating the point of borrowing.
+		c.borrowed[class][lender]++
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	bucket.Accept()
+}
+
+// borrowableBucketLocked returns a lower-priority class's bucket that
+// class may still borrow from (has spare capacity right now, and hasn't
+// hit borrowCeiling borrows from it yet), if any. c.mu must be held.
+func (c *classRateLimiter) borrowableBucketLocked(class RequestClass) (RequestClass, flowcontrol.RateLimiter, bool) {
+	borrowCeiling := c.borrowCeilings[class]
+	if borrowCeiling <= 0 {
+		return "", nil, false
+	}
+	priority, ok := classPriority[class]
+	if !ok {
+		return "", nil, false
+	}
+	if c.borrowed[class] == nil {
+		c.borrowed[class] = make(map[RequestClass]int)
+	}
+	for lender, bucket := range c.buckets {
+		lenderPriority, ok := classPriority[lender]
+		if !ok || lenderPriority <= priority {
+			continue
+		}
+		if c.borrowed[class][lender] >= borrowCeiling {
+			continue
+		}
+		if bucket.TryAccept() {
+			return lender, bucket, true
+		}
+	}
+	return "", nil, false
+}
+
+// lowestPriorityBucketLocked returns the configured bucket for the
+// lowest-priority class, if any are configured. c.mu must be held.
+func (c *classRateLimiter) lowestPriorityBucketLocked() (flowcontrol.RateLimiter, bool) {
+	var (
+		bucket   flowcontrol.RateLimiter
+		lowest   = -1
+		selected bool
+	)
+	for class, b := range c.buckets {
+		if priority := classPriority[class]; priority > lowest {
+			lowest = priority
+			bucket = b
+			selected = true
+		}
+	}
+	return bucket, selected
+}
+
+// fairQueueRateLimiter shares a single token bucket across all request
+// classes for a key, but serves waiters for that bucket in order of class
+// priority and then FIFO within a class, so a request queued behind a
+// large batch of background traffic is not stuck behind it once a token
+// frees up.
+type fairQueueRateLimiter struct {
+	bucket flowcontrol.RateLimiter
+
+	mu      sync.Mutex
+	waiters waiterHeap
+	seq     int
+	serving bool
+}
+
+func newFairQueueRateLimiter(qps float32, burst int) *fairQueueRateLimiter {
+	return &fairQueueRateLimiter{bucket: flowcontrol.NewTokenBucketRateLimiter(qps, burst)}
+}
+
+// Accept implements rateLimiterImpl.
+func (f *fairQueueRateLimiter) Accept(ctx context.Context, key *cloud.RateLimitKey) {
+	w := &waiter{priority: classPriority[classFromContext(ctx)], done: make(chan struct{})}
+	f.mu.Lock()
+	f.seq++
+	w.seq = f.seq
+	heap.Push(&f.waiters, w)
+	f.maybeServeLocked()
+	f.mu.Unlock()
+	<-w.done
+}
+
+// maybeServeLocked starts serving the next waiter, if any, and none is
+// already being served. f.mu must be held.
+func (f *fairQueueRateLimiter) maybeServeLocked() {
+	if f.serving || f.waiters.Len() == 0 {
+		return
+	}
+	f.serving = true
+	next := heap.Pop(&f.waiters).(*waiter)
+	go func() {
+		f.bucket.Accept()
+		close(next.done)
+		f.mu.Lock()
+		f.serving = false
+		f.maybeServeLocked()
+		f.mu.Unlock()
+	}()
+}
+
+// waiter is a single Accept() call queued on a fairQueueRateLimiter.
+type waiter struct {
+	priority int
+	seq      int
+	done     chan struct{}
+}
+
+// waiterHeap is a container/heap.Interface ordering waiters by priority
+// (lower is higher priority) and then by seq (FIFO within a priority).
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h waiterHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *waiterHeap) Push(x interface{}) {
+	*h = append(*h, x.(*waiter))
+}
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"container/heap"
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/cloudprovider/providers/gce/cloud"
+	"k8s.io/kubernetes/pkg/cloudprovider/providers/gce/cloud/meta"
+)
+
+func TestClassRateLimiterBorrowing(t *testing.T) {
+	limiter, err := NewGCERateLimiter([]string{
+		// A near-zero QPS means the interactive bucket effectively never
+		// refills within the test, so a second interactive call can only
+		// succeed by borrowing.
+		"ga.Addresses.Get,qps,0.001,1,class=interactive,borrow=1",
+		"ga.Addresses.Get,qps,1000,1,class=background",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from NewGCERateLimiter: %v", err)
+	}
+	key := &cloud.RateLimitKey{Version: meta.VersionGA, Service: "Addresses", Operation: "Get"}
+
+	interactiveCtx := WithClass(context.Background(), ClassInteractive)
+	// Drain the interactive bucket's single token.
+	if err := limiter.Accept(interactiveCtx, key); err != nil {
+		t.Fatalf("unexpected error from Accept: %v", err)
+	}
+	// The interactive bucket is now empty; the next interactive call should
+	// borrow a token from the untouched background bucket instead of
+	// blocking on its own, effectively unrefillable bucket.
+	done := make(chan struct{})
+	go func() {
+		limiter.Accept(interactiveCtx, key)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("expected interactive Accept to borrow from the background bucket instead of blocking")
+	}
+}
+
+func TestClassRateLimiterBorrowingIndependentOfSpecOrder(t *testing.T) {
+	limiter, err := NewGCERateLimiter([]string{
+		// The non-borrowing class is listed first here, the opposite order
+		// from TestClassRateLimiterBorrowing, so a borrow ceiling keyed off
+		// whichever spec is parsed first for this key would come from this
+		// line (borrow=0) and silently disable borrowing for the whole key.
+		"ga.Addresses.Get,qps,1000,1,class=background",
+		"ga.Addresses.Get,qps,0.001,1,class=interactive,borrow=1",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from NewGCERateLimiter: %v", err)
+	}
+	key := &cloud.RateLimitKey{Version: meta.VersionGA, Service: "Addresses", Operation: "Get"}
+
+	interactiveCtx := WithClass(context.Background(), ClassInteractive)
+	if err := limiter.Accept(interactiveCtx, key); err != nil {
+		t.Fatalf("unexpected error from Accept: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		limiter.Accept(interactiveCtx, key)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("expected interactive Accept to borrow from the background bucket regardless of spec order, but it blocked")
+	}
+}
+
+func TestClassRateLimiterBorrowDoesNotDoubleConsumeLender(t *testing.T) {
+	// A low-QPS lender means a second Accept() on its bucket would block for
+	// close to a refill period; if borrowing consumed a lender token via
+	// TryAccept and then blocked on lenderBucket.Accept() for a second one,
+	// this call would not return within the timeout below.
+	c := newClassRateLimiter()
+	if err := c.setClass(ClassInteractive, 0.001, 1, 1); err != nil {
+		t.Fatalf("unexpected error from setClass: %v", err)
+	}
+	if err := c.setClass(ClassBackground, 1, 1, 0); err != nil {
+		t.Fatalf("unexpected error from setClass: %v", err)
+	}
+	interactiveCtx := WithClass(context.Background(), ClassInteractive)
+
+	// Drain the interactive bucket's single token.
+	c.Accept(interactiveCtx, nil)
+
+	done := make(chan struct{})
+	go func() {
+		// This borrows the background bucket's only token.
+		c.Accept(interactiveCtx, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("borrowed Accept did not return promptly; lender token was likely consumed twice")
+	}
+
+	// The background bucket should now have exactly zero tokens left, i.e.
+	// a background caller must wait for a refill rather than finding a
+	// second token available.
+	if c.buckets[ClassBackground].TryAccept() {
+		t.Errorf("expected background bucket to be empty after a single borrow, but it had another token")
+	}
+}
+
+func TestWaiterHeapOrdersByPriorityThenFIFO(t *testing.T) {
+	h := &waiterHeap{}
+	background1 := &waiter{priority: classPriority[ClassBackground], seq: 1}
+	background2 := &waiter{priority: classPriority[ClassBackground], seq: 2}
+	interactive := &waiter{priority: classPriority[ClassInteractive], seq: 3}
+	heap.Init(h)
+	heap.Push(h, background1)
+	heap.Push(h, background2)
+	heap.Push(h, interactive)
+
+	want := []*waiter{interactive, background1, background2}
+	for i, w := range want {
+		got := heap.Pop(h).(*waiter)
+		if got != w {
+			t.Errorf("pop %d: got waiter with priority %d seq %d, want priority %d seq %d", i, got.priority, got.seq, w.priority, w.seq)
+		}
+	}
+}
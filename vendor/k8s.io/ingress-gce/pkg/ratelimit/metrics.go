@@ -0,0 +1,154 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/kubernetes/pkg/cloudprovider/providers/gce/cloud"
+)
+
+const metricsSubsystem = "gce_rate_limiter"
+
+var (
+	acceptTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: metricsSubsystem,
+			Name:      "accept_total",
+			Help:      "Number of Accept() calls made against the GCE rate limiter.",
+		},
+		[]string{"version", "service", "operation"},
+	)
+	acceptLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Subsystem: metricsSubsystem,
+			Name:      "accept_latency_seconds",
+			Help:      "Time spent waiting in Accept() for a token to be granted.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"version", "service", "operation"},
+	)
+	cancelledTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: metricsSubsystem,
+			Name:      "accept_cancelled_total",
+			Help:      "Number of Accept() calls that returned early because their context was cancelled.",
+		},
+		[]string{"version", "service", "operation"},
+	)
+	currentQPS = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: metricsSubsystem,
+			Name:      "current_qps",
+			Help:      "Currently configured QPS of the token bucket backing a key, reflecting any adaptive adjustment.",
+		},
+		[]string{"version", "service", "operation"},
+	)
+)
+
+var registerMetricsOnce sync.Once
+
+// RegisterMetrics registers the GCE rate limiter's Prometheus collectors
+// with the default registry. It is safe to call multiple times;
+// registration only happens once.
+func RegisterMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(acceptTotal, acceptLatency, cancelledTotal, currentQPS)
+	})
+}
+
+// qpsReporter is optionally implemented by a cloud.RateLimiter which can
+// report the currently configured QPS for a key, e.g. so MetricsRateLimiter
+// can surface an adaptive limiter's backoff.
+type qpsReporter interface {
+	QPS(key *cloud.RateLimitKey) (qps float32, ok bool)
+}
+
+// QPS returns the currently configured QPS for key's rate limiter impl, if
+// any. The second return value is false if key has no configured impl, or
+// the impl does not expose a QPS.
+func (l *GCERateLimiter) QPS(key *cloud.RateLimitKey) (float32, bool) {
+	switch v := l.rateLimitImpl(key).(type) {
+	case *tokenBucketRateLimiter:
+		return v.RateLimiter.QPS(), true
+	case *adaptiveRateLimiter:
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		return v.qps, true
+	}
+	return 0, false
+}
+
+// MetricsRateLimiter decorates a cloud.RateLimiter, recording Prometheus
+// metrics around every Accept() call: how many calls were made, how long
+// each spent waiting for a token, how many were abandoned via context
+// cancellation, and, when the delegate exposes it, the currently
+// configured QPS for the key. It does not itself throttle.
+type MetricsRateLimiter struct {
+	delegate cloud.RateLimiter
+}
+
+// NewMetricsRateLimiter returns a MetricsRateLimiter which records metrics
+// for calls to delegate.
+func NewMetricsRateLimiter(delegate cloud.RateLimiter) *MetricsRateLimiter {
+	return &MetricsRateLimiter{delegate: delegate}
+}
+
+// NewGCERateLimiterWithMetrics is a convenience wrapper around
+// NewGCERateLimiter that additionally wraps the result in a
+// MetricsRateLimiter, so operators can see which GCE operations are being
+// throttled and by how much.
+func NewGCERateLimiterWithMetrics(specs []string) (*MetricsRateLimiter, error) {
+	limiter, err := NewGCERateLimiter(specs)
+	if err != nil {
+		return nil, err
+	}
+	if limiter == nil {
+		// NewGCERateLimiter returns a nil *GCERateLimiter for an empty spec
+		// list. Wrapping that nil in MetricsRateLimiter would hide it inside
+		// a non-nil cloud.RateLimiter interface value, so the caller's nil
+		// check would pass and the first Accept would panic dereferencing
+		// the nil receiver.
+		return nil, nil
+	}
+	return NewMetricsRateLimiter(limiter), nil
+}
+
+// Accept implements cloud.RateLimiter.
+func (m *MetricsRateLimiter) Accept(ctx context.Context, key *cloud.RateLimitKey) error {
+	labels := prometheus.Labels{
+		"version":   string(key.Version),
+		"service":   key.Service,
+		"operation": key.Operation,
+	}
+	acceptTotal.With(labels).Inc()
+	start := time.Now()
+	err := m.delegate.Accept(ctx, key)
+	acceptLatency.With(labels).Observe(time.Since(start).Seconds())
+	if err != nil && err == ctx.Err() {
+		cancelledTotal.With(labels).Inc()
+	}
+	if reporter, ok := m.delegate.(qpsReporter); ok {
+		if qps, ok := reporter.QPS(key); ok {
+			currentQPS.With(labels).Set(float64(qps))
+		}
+	}
+	return err
+}
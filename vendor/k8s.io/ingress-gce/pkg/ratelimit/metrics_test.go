@@ -0,0 +1,46 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/cloudprovider/providers/gce/cloud"
+	"k8s.io/kubernetes/pkg/cloudprovider/providers/gce/cloud/meta"
+)
+
+func TestMetricsRateLimiterAccept(t *testing.T) {
+	limiter, err := NewGCERateLimiterWithMetrics([]string{"ga.Addresses.Get,qps,1000,1000"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewGCERateLimiterWithMetrics: %v", err)
+	}
+	key := &cloud.RateLimitKey{Version: meta.VersionGA, Service: "Addresses", Operation: "Get"}
+	if err := limiter.Accept(context.Background(), key); err != nil {
+		t.Errorf("unexpected error from Accept: %v", err)
+	}
+}
+
+func TestNewGCERateLimiterWithMetricsEmptySpecs(t *testing.T) {
+	limiter, err := NewGCERateLimiterWithMetrics(nil)
+	if err != nil {
+		t.Fatalf("unexpected error from NewGCERateLimiterWithMetrics: %v", err)
+	}
+	if limiter != nil {
+		t.Fatalf("expected a nil *MetricsRateLimiter for an empty spec list, got %#v", limiter)
+	}
+}
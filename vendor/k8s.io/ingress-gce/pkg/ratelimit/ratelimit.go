@@ -19,26 +19,65 @@ package ratelimit
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/golang/glog"
+	"google.golang.org/api/googleapi"
 	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/kubernetes/pkg/cloudprovider/providers/gce/cloud"
 	"k8s.io/kubernetes/pkg/cloudprovider/providers/gce/cloud/meta"
 )
 
+// rateLimiterImpl is implemented by every rate limiter type that can be
+// constructed from a spec. Unlike flowcontrol.RateLimiter, Accept is
+// passed the full key (including ProjectID, which GCERateLimiter strips
+// before using a key to look up its impl) so implementations such as
+// perProjectRateLimiter can key off fields a plain token bucket cannot,
+// and the context, so implementations such as classRateLimiter can consult
+// the RequestClass attached by WithClass.
+type rateLimiterImpl interface {
+	Accept(ctx context.Context, key *cloud.RateLimitKey)
+}
+
+// observer is optionally implemented by a rateLimiterImpl that wants to
+// react to the outcome of the call it gated, e.g. an adaptive limiter
+// backing off after a 429/503 from GCE.
+type observer interface {
+	Observe(key *cloud.RateLimitKey, err error)
+}
+
 // GCERateLimiter implements cloud.RateLimiter
 type GCERateLimiter struct {
+	// mu guards rateLimitImpls so that Reload can swap it out atomically
+	// without racing with in-flight Accept/Observe calls.
+	mu sync.RWMutex
 	// Map a RateLimitKey to its rate limiter implementation.
-	rateLimitImpls map[cloud.RateLimitKey]flowcontrol.RateLimiter
+	rateLimitImpls map[cloud.RateLimitKey]rateLimiterImpl
 }
 
 // NewGCERateLimiter parses the list of rate limiting specs passed in and
 // returns a properly configured cloud.RateLimiter implementation.
 // Expected format of specs: {"[version].[service].[operation],[type],[param1],[param2],..", "..."}
 func NewGCERateLimiter(specs []string) (*GCERateLimiter, error) {
-	rateLimitImpls := make(map[cloud.RateLimitKey]flowcontrol.RateLimiter)
+	rateLimitImpls, err := parseSpecs(specs)
+	if err != nil {
+		return nil, err
+	}
+	if len(rateLimitImpls) == 0 {
+		return nil, nil
+	}
+	return &GCERateLimiter{rateLimitImpls: rateLimitImpls}, nil
+}
+
+// parseSpecs parses specs into a map of RateLimitKey to rateLimiterImpl.
+// It is used both to build a GCERateLimiter from scratch and, by Reload, to
+// validate a replacement configuration before it is swapped in.
+func parseSpecs(specs []string) (map[cloud.RateLimitKey]rateLimiterImpl, error) {
+	rateLimitImpls := make(map[cloud.RateLimitKey]rateLimiterImpl)
+	classLimiters := make(map[cloud.RateLimitKey]*classRateLimiter)
 	// Within each specification, split on comma to get the operation,
 	// rate limiter type, and extra parameters.
 	for _, spec := range specs {
@@ -51,28 +90,74 @@ func NewGCERateLimiter(specs []string) (*GCERateLimiter, error) {
 		if err != nil {
 			return nil, err
 		}
-		// params[1:] should consist of the rate limiter type and extra params.
-		impl, err := constructRateLimitImpl(params[1:])
+		// params[1:] should consist of the rate limiter type, extra params,
+		// and any class=/borrow= modifiers.
+		implParams, class, borrowCeiling, err := extractClassModifiers(params[1:])
 		if err != nil {
 			return nil, err
 		}
-		rateLimitImpls[key] = impl
+		if class == "" {
+			if borrowCeiling != 0 {
+				return nil, fmt.Errorf("borrow= has no effect without class=: %v", spec)
+			}
+			impl, err := constructRateLimitImpl(implParams)
+			if err != nil {
+				return nil, err
+			}
+			rateLimitImpls[key] = impl
+		} else {
+			if len(implParams) == 0 || implParams[0] != "qps" {
+				return nil, fmt.Errorf("class= is only supported for rate limiter type qps: %v", spec)
+			}
+			qps, burst, err := parseQPSBurst("qps", implParams[1:])
+			if err != nil {
+				return nil, err
+			}
+			cl, ok := classLimiters[key]
+			if !ok {
+				cl = newClassRateLimiter()
+				classLimiters[key] = cl
+				rateLimitImpls[key] = cl
+			}
+			if err := cl.setClass(class, qps, burst, borrowCeiling); err != nil {
+				return nil, err
+			}
+		}
 		glog.Infof("Configured rate limiting for: %v", key)
 	}
-	if len(rateLimitImpls) == 0 {
-		return nil, nil
+	return rateLimitImpls, nil
+}
+
+// Reload atomically replaces the configured rate limit specs. If any spec
+// in specs fails to parse, the previous configuration is left untouched and
+// an error is returned. In-flight Accept/Observe calls are unaffected: they
+// either finish against the map that was current when they started, or
+// against the newly swapped-in one, but never see a partially-applied
+// update.
+//
+// Reload has no caller in this repo: kubemci only vendors this package for
+// its "ratelimit validate" CLI subcommand, it does not run the ingress-gce
+// controller. Watching a ConfigMap and calling Reload on updates belongs in
+// that controller's main, alongside its existing informers.
+func (l *GCERateLimiter) Reload(specs []string) error {
+	rateLimitImpls, err := parseSpecs(specs)
+	if err != nil {
+		return err
 	}
-	return &GCERateLimiter{rateLimitImpls}, nil
+	l.mu.Lock()
+	l.rateLimitImpls = rateLimitImpls
+	l.mu.Unlock()
+	return nil
 }
 
 // Implementation of cloud.RateLimiter
 func (l *GCERateLimiter) Accept(ctx context.Context, key *cloud.RateLimitKey) error {
 	ch := make(chan struct{})
 	go func() {
-		// Call flowcontrol.RateLimiter implementation.
+		// Call the rateLimiterImpl associated with key, if any.
 		impl := l.rateLimitImpl(key)
 		if impl != nil {
-			impl.Accept()
+			impl.Accept(ctx, key)
 		}
 		close(ch)
 	}()
@@ -85,9 +170,20 @@ func (l *GCERateLimiter) Accept(ctx context.Context, key *cloud.RateLimitKey) er
 	return nil
 }
 
-// rateLimitImpl returns the flowcontrol.RateLimiter implementation
-// associated with the passed in key.
-func (l *GCERateLimiter) rateLimitImpl(key *cloud.RateLimitKey) flowcontrol.RateLimiter {
+// Observe reports the outcome of the GCE call that a prior Accept(ctx, key)
+// gated, so rate limiter implementations which track outcomes (e.g. the
+// adaptive limiter) can adjust themselves. It is a no-op for keys with no
+// configured impl, or an impl which does not implement observer.
+func (l *GCERateLimiter) Observe(key *cloud.RateLimitKey, err error) {
+	impl := l.rateLimitImpl(key)
+	if o, ok := impl.(observer); ok {
+		o.Observe(key, err)
+	}
+}
+
+// rateLimitImpl returns the rateLimiterImpl associated with the passed in
+// key.
+func (l *GCERateLimiter) rateLimitImpl(key *cloud.RateLimitKey) rateLimiterImpl {
 	// Since the passed in key will have the ProjectID field filled in, we need to
 	// create a copy which does not, so that retreiving the rate limiter implementation
 	// through the map works as expected.
@@ -97,6 +193,8 @@ func (l *GCERateLimiter) rateLimitImpl(key *cloud.RateLimitKey) flowcontrol.Rate
 		Version:   key.Version,
 		Service:   key.Service,
 	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
 	return l.rateLimitImpls[keyCopy]
 }
 
@@ -120,25 +218,283 @@ func constructRateLimitKey(param string) (cloud.RateLimitKey, error) {
 	return retVal, nil
 }
 
-// constructRateLimitImpl parses the slice and returns a flowcontrol.RateLimiter
+// constructRateLimitImpl parses the slice and returns a rateLimiterImpl.
 // Expected format is [type],[param1],[param2],...
-func constructRateLimitImpl(params []string) (flowcontrol.RateLimiter, error) {
-	// For now, only the "qps" type is supported.
+func constructRateLimitImpl(params []string) (rateLimiterImpl, error) {
+	if len(params) == 0 {
+		return nil, fmt.Errorf("Must specify a rate limiter type.")
+	}
 	rlType := params[0]
 	implArgs := params[1:]
-	if rlType == "qps" {
-		if len(implArgs) != 2 {
-			return nil, fmt.Errorf("Invalid number of args for rate limiter type %v. Expected %d, Got %v", rlType, 2, len(implArgs))
+	switch rlType {
+	case "qps":
+		qps, burst, err := parseQPSBurst(rlType, implArgs)
+		if err != nil {
+			return nil, err
 		}
-		qps, err := strconv.ParseFloat(implArgs[0], 32)
-		if err != nil || qps <= 0 {
-			return nil, fmt.Errorf("Invalid argument for rate limiter type %v. Either %v is not a float or not greater than 0.", rlType, implArgs[0])
+		return &tokenBucketRateLimiter{flowcontrol.NewTokenBucketRateLimiter(qps, burst)}, nil
+	case "adaptive":
+		return constructAdaptiveRateLimitImpl(implArgs)
+	case "perProject":
+		qps, burst, err := parseQPSBurst(rlType, implArgs)
+		if err != nil {
+			return nil, err
 		}
-		burst, err := strconv.Atoi(implArgs[1])
+		return newPerProjectRateLimiter(qps, burst), nil
+	case "composite":
+		return constructCompositeRateLimitImpl(implArgs)
+	case "fairclass":
+		qps, burst, err := parseQPSBurst(rlType, implArgs)
 		if err != nil {
-			return nil, fmt.Errorf("Invalid argument for rate limiter type %v. Expected %v to be a int.", rlType, implArgs[1])
+			return nil, err
 		}
-		return flowcontrol.NewTokenBucketRateLimiter(float32(qps), burst), nil
+		return newFairQueueRateLimiter(qps, burst), nil
 	}
 	return nil, fmt.Errorf("Invalid rate limiter type provided: %v", rlType)
 }
+
+// extractClassModifiers pulls a trailing "class=<name>" and an optional
+// "borrow=<n>" modifier out of implParams, returning the remaining
+// positional params, the parsed class ("" if none was given), and the
+// borrow ceiling (0 if none was given). Modifiers may appear anywhere
+// after the positional params, in any order.
+func extractClassModifiers(implParams []string) ([]string, RequestClass, int, error) {
+	var class RequestClass
+	borrowCeiling := 0
+	rest := make([]string, 0, len(implParams))
+	for _, p := range implParams {
+		switch {
+		case strings.HasPrefix(p, "class="):
+			class = RequestClass(strings.TrimPrefix(p, "class="))
+			if _, ok := classPriority[class]; !ok {
+				return nil, "", 0, fmt.Errorf("Unknown request class: %v", class)
+			}
+		case strings.HasPrefix(p, "borrow="):
+			n, err := strconv.Atoi(strings.TrimPrefix(p, "borrow="))
+			if err != nil {
+				return nil, "", 0, fmt.Errorf("Invalid borrow ceiling: %v", p)
+			}
+			borrowCeiling = n
+		default:
+			rest = append(rest, p)
+		}
+	}
+	return rest, class, borrowCeiling, nil
+}
+
+// parseQPSBurst parses the [qps],[burst] arguments shared by the "qps",
+// "perProject" and "fairclass" rate limiter types, and by class= specs.
+func parseQPSBurst(rlType string, implArgs []string) (float32, int, error) {
+	if len(implArgs) != 2 {
+		return 0, 0, fmt.Errorf("Invalid number of args for rate limiter type %v. Expected %d, Got %v", rlType, 2, len(implArgs))
+	}
+	qps, err := strconv.ParseFloat(implArgs[0], 32)
+	if err != nil || qps <= 0 {
+		return 0, 0, fmt.Errorf("Invalid argument for rate limiter type %v. Either %v is not a float or not greater than 0.", rlType, implArgs[0])
+	}
+	burst, err := strconv.Atoi(implArgs[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid argument for rate limiter type %v. Expected %v to be a int.", rlType, implArgs[1])
+	}
+	return float32(qps), burst, nil
+}
+
+// constructAdaptiveRateLimitImpl parses the [minQPS],[maxQPS],[burst]
+// arguments for the "adaptive" rate limiter type.
+func constructAdaptiveRateLimitImpl(implArgs []string) (rateLimiterImpl, error) {
+	if len(implArgs) != 3 {
+		return nil, fmt.Errorf("Invalid number of args for rate limiter type adaptive. Expected %d, Got %v", 3, len(implArgs))
+	}
+	minQPS, err := strconv.ParseFloat(implArgs[0], 32)
+	if err != nil || minQPS <= 0 {
+		return nil, fmt.Errorf("Invalid argument for rate limiter type adaptive. Either %v is not a float or not greater than 0.", implArgs[0])
+	}
+	maxQPS, err := strconv.ParseFloat(implArgs[1], 32)
+	if err != nil || maxQPS < minQPS {
+		return nil, fmt.Errorf("Invalid argument for rate limiter type adaptive. Either %v is not a float or is less than minQPS.", implArgs[1])
+	}
+	burst, err := strconv.Atoi(implArgs[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid argument for rate limiter type adaptive. Expected %v to be a int.", implArgs[2])
+	}
+	return newAdaptiveRateLimiter(float32(minQPS), float32(maxQPS), burst), nil
+}
+
+// constructCompositeRateLimitImpl parses a list of "type:param1:param2"
+// child specs, one per remaining arg, and chains their rateLimiterImpls
+// together.
+func constructCompositeRateLimitImpl(implArgs []string) (rateLimiterImpl, error) {
+	if len(implArgs) == 0 {
+		return nil, fmt.Errorf("Must specify at least one child rate limiter for type composite.")
+	}
+	children := make([]rateLimiterImpl, 0, len(implArgs))
+	for _, childSpec := range implArgs {
+		childParams := strings.Split(childSpec, ":")
+		child, err := constructRateLimitImpl(childParams)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid child rate limiter %q for type composite: %v", childSpec, err)
+		}
+		children = append(children, child)
+	}
+	return &compositeRateLimiter{children}, nil
+}
+
+// tokenBucketRateLimiter adapts a flowcontrol.RateLimiter, the plain "qps"
+// type, to rateLimiterImpl.
+type tokenBucketRateLimiter struct {
+	flowcontrol.RateLimiter
+}
+
+func (t *tokenBucketRateLimiter) Accept(ctx context.Context, key *cloud.RateLimitKey) {
+	t.RateLimiter.Accept()
+}
+
+// perProjectRateLimiter maintains an independent token bucket per
+// ProjectID. Some GCE quotas (e.g. Operations.Get) are enforced per
+// project rather than globally, so a single shared bucket across all
+// projects the controller manages would throttle projects that are
+// nowhere near their own quota.
+type perProjectRateLimiter struct {
+	qps   float32
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]flowcontrol.RateLimiter
+}
+
+func newPerProjectRateLimiter(qps float32, burst int) *perProjectRateLimiter {
+	return &perProjectRateLimiter{
+		qps:     qps,
+		burst:   burst,
+		buckets: make(map[string]flowcontrol.RateLimiter),
+	}
+}
+
+func (p *perProjectRateLimiter) Accept(ctx context.Context, key *cloud.RateLimitKey) {
+	p.mu.Lock()
+	bucket, ok := p.buckets[key.ProjectID]
+	if !ok {
+		bucket = flowcontrol.NewTokenBucketRateLimiter(p.qps, p.burst)
+		p.buckets[key.ProjectID] = bucket
+	}
+	p.mu.Unlock()
+	bucket.Accept()
+}
+
+// adaptiveRateLimiter is an AIMD limiter: on Observe it additively
+// increases its QPS up to maxQPS after any call which was not throttled
+// (including calls which failed with some other error), and
+// multiplicatively halves it down to minQPS after a call which was
+// throttled by GCE (HTTP 429 or 503), so bursts of throttling responses
+// back off automatically instead of requiring an operator to retune a
+// static spec.
+type adaptiveRateLimiter struct {
+	minQPS, maxQPS float32
+	burst          int
+
+	mu      sync.Mutex
+	qps     float32
+	limiter flowcontrol.RateLimiter
+}
+
+func newAdaptiveRateLimiter(minQPS, maxQPS float32, burst int) *adaptiveRateLimiter {
+	return &adaptiveRateLimiter{
+		minQPS:  minQPS,
+		maxQPS:  maxQPS,
+		burst:   burst,
+		qps:     minQPS,
+		limiter: flowcontrol.NewTokenBucketRateLimiter(minQPS, burst),
+	}
+}
+
+func (a *adaptiveRateLimiter) Accept(ctx context.Context, key *cloud.RateLimitKey) {
+	a.mu.Lock()
+	limiter := a.limiter
+	a.mu.Unlock()
+	limiter.Accept()
+}
+
+func (a *adaptiveRateLimiter) Observe(key *cloud.RateLimitKey, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	oldQPS := a.qps
+	if isThrottled(err) {
+		a.qps = a.qps / 2
+		if a.qps < a.minQPS {
+			a.qps = a.minQPS
+		}
+	} else {
+		a.qps++
+		if a.qps > a.maxQPS {
+			a.qps = a.maxQPS
+		}
+	}
+	if a.qps == oldQPS {
+		// Rebuilding the limiter here, even with the same QPS, would
+		// refill it to a full burst on every successful call, so a
+		// sustained run of successes would never actually throttle.
+		return
+	}
+	a.limiter = resizeTokenBucket(a.limiter, a.qps, a.burst)
+}
+
+// resizeTokenBucket replaces old with a new token bucket rate limiter of
+// the given qps and burst, carrying over old's outstanding token debt
+// instead of granting a fresh full burst. A freshly constructed
+// flowcontrol.RateLimiter always starts full, so naively swapping in a new
+// one on every QPS adjustment would refill the bucket on every Observe: an
+// adaptive limiter backing off after a 429/503 would hand out a full burst
+// of tokens in the same breath it halved its QPS, and one ramping up after
+// a success would never accumulate the wait it's supposed to enforce at
+// the old, lower QPS.
+//
+// flowcontrol.RateLimiter exposes no way to read the bucket's current
+// token count directly, so this drains old via TryAccept to count what it
+// had available (bounded by burst), then drains the same number of tokens
+// from a freshly created bucket so it starts at the same level rather than
+// full.
+func resizeTokenBucket(old flowcontrol.RateLimiter, qps float32, burst int) flowcontrol.RateLimiter {
+	available := 0
+	for available < burst && old.TryAccept() {
+		available++
+	}
+	old.Stop()
+	next := flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	for i := 0; i < burst-available; i++ {
+		next.TryAccept()
+	}
+	return next
+}
+
+// isThrottled reports whether err is a GCE 429 (Too Many Requests) or 503
+// (Service Unavailable) response, the signals the adaptive limiter backs
+// off on.
+func isThrottled(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	return gerr.Code == http.StatusTooManyRequests || gerr.Code == http.StatusServiceUnavailable
+}
+
+// compositeRateLimiter chains multiple rateLimiterImpls under a single
+// key; Accept blocks until every child has granted a token, so all
+// configured limits apply simultaneously. Observe is forwarded to every
+// child which implements observer.
+type compositeRateLimiter struct {
+	children []rateLimiterImpl
+}
+
+func (c *compositeRateLimiter) Accept(ctx context.Context, key *cloud.RateLimitKey) {
+	for _, child := range c.children {
+		child.Accept(ctx, key)
+	}
+}
+
+func (c *compositeRateLimiter) Observe(key *cloud.RateLimitKey, err error) {
+	for _, child := range c.children {
+		if o, ok := child.(observer); ok {
+			o.Observe(key, err)
+		}
+	}
+}
@@ -17,7 +17,15 @@ limitations under the License.
 package ratelimit
 
 import (
+	"context"
+	"net/http"
+	"sync"
 	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"k8s.io/kubernetes/pkg/cloudprovider/providers/gce/cloud"
+	"k8s.io/kubernetes/pkg/cloudprovider/providers/gce/cloud/meta"
 )
 
 func TestConfigureGCERateLimiting(t *testing.T) {
@@ -26,6 +34,12 @@ func TestConfigureGCERateLimiting(t *testing.T) {
 		[]string{"ga.Addresses.List,qps,2,10"},
 		[]string{"ga.Addresses.Get,qps,1.5,5", "ga.Firewalls.Get,qps,1.5,5"},
 		[]string{"ga.Operations.Get,qps,10,100"},
+		[]string{"ga.Addresses.Get,adaptive,1,10,5"},
+		[]string{"ga.Operations.Get,perProject,2,10"},
+		[]string{"ga.Addresses.Get,composite,qps:1.5:5,perProject:2:10"},
+		[]string{"ga.Addresses.Get,qps,1.5,5,class=reconcile"},
+		[]string{"ga.Addresses.Get,qps,1.5,5,class=interactive,borrow=2", "ga.Addresses.Get,qps,0.5,2,class=background"},
+		[]string{"ga.Addresses.Get,fairclass,1.5,5"},
 	}
 	invalidTestCases := [][]string{
 		[]string{"gaAddresses.Get,qps,1.5,5"},
@@ -38,6 +52,15 @@ func TestConfigureGCERateLimiting(t *testing.T) {
 		[]string{"ga.Addresses.Get,foo,1.5,5"},
 		[]string{"ga.Addresses.Get,1.5,5"},
 		[]string{"ga.Addresses.Get,qps,1.5,5", "gaFirewalls.Get,qps,1.5,5"},
+		[]string{"ga.Addresses.Get,adaptive,10,1,5"},
+		[]string{"ga.Addresses.Get,adaptive,1,10"},
+		[]string{"ga.Operations.Get,perProject,0,10"},
+		[]string{"ga.Addresses.Get,composite"},
+		[]string{"ga.Addresses.Get,composite,foo:1.5:5"},
+		[]string{"ga.Addresses.Get,qps,1.5,5,class=urgent"},
+		[]string{"ga.Addresses.Get,perProject,1.5,5,class=reconcile"},
+		[]string{"ga.Addresses.Get,qps,1.5,5,borrow=notanumber"},
+		[]string{"ga.Addresses.Get,qps,1.5,5,borrow=3"},
 	}
 
 	for _, testCase := range validTestCases {
@@ -54,3 +77,133 @@ func TestConfigureGCERateLimiting(t *testing.T) {
 		}
 	}
 }
+
+func TestAdaptiveRateLimiterObserveDoesNotResetOnSuccess(t *testing.T) {
+	// minQPS == maxQPS keeps a.qps pinned at 1 across every Observe call
+	// below, isolating the bug: Observe used to rebuild the token bucket
+	// from scratch on every call regardless of whether qps changed, so a
+	// sustained run of successes kept refilling it to a full burst and it
+	// never actually throttled.
+	a := newAdaptiveRateLimiter(1, 1, 1)
+
+	// Drain the single burst token.
+	a.Accept(nil, nil)
+
+	// Observe a run of successes; qps stays at 1 throughout.
+	for i := 0; i < 5; i++ {
+		a.Observe(nil, nil)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		a.Accept(nil, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Errorf("expected Accept to block near the 1 QPS limit after a run of successful Observes, but it returned immediately")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestAdaptiveRateLimiterObservePreservesTokenDebtAcrossResize(t *testing.T) {
+	// minQPS != maxQPS so the first successful Observe below actually
+	// changes qps and triggers a resize.
+	a := newAdaptiveRateLimiter(1, 10, 1)
+
+	// Drain the initial burst token.
+	a.Accept(nil, nil)
+
+	// A success bumps qps from 1 to 2, resizing the limiter. The resized
+	// bucket must carry over the fact that the old one was empty, not
+	// start over with a full burst.
+	a.Observe(nil, nil)
+	if a.limiter.TryAccept() {
+		t.Errorf("expected the resized bucket to have no tokens available, but it granted one")
+	}
+}
+
+func TestAdaptiveRateLimiterObserveBacksOffImmediatelyOnThrottle(t *testing.T) {
+	a := newAdaptiveRateLimiter(1, 10, 5)
+
+	// Ramp qps up through a run of successes so a throttled response below
+	// is halving an intermediate QPS, not just bouncing off minQPS.
+	for i := 0; i < 3; i++ {
+		a.Observe(nil, nil)
+	}
+	for a.limiter.TryAccept() {
+		// Drain whatever the ramp-up left in the bucket.
+	}
+
+	// A throttled response halves qps and resizes the limiter; it must not
+	// hand out a fresh burst of tokens in the same breath it's backing
+	// off.
+	a.Observe(nil, &googleapi.Error{Code: http.StatusTooManyRequests})
+	if a.limiter.TryAccept() {
+		t.Errorf("expected the resized bucket to have no tokens available right after backing off, but it granted one")
+	}
+}
+
+func TestReload(t *testing.T) {
+	limiter, err := NewGCERateLimiter([]string{"ga.Addresses.Get,qps,1.5,5"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewGCERateLimiter: %v", err)
+	}
+
+	// A spec which fails to parse must leave the previous configuration
+	// untouched.
+	if err := limiter.Reload([]string{"ga.Addresses.Get,qps,1.5,5", "gaFirewalls.Get,qps,1.5,5"}); err == nil {
+		t.Errorf("Expected an error reloading an invalid spec")
+	}
+	if _, ok := limiter.rateLimitImpls[cloud.RateLimitKey{Version: meta.VersionGA, Service: "Addresses", Operation: "Get"}]; !ok {
+		t.Errorf("Reload with an invalid spec should not have modified the existing configuration")
+	}
+
+	// A valid reload should replace the configuration.
+	if err := limiter.Reload([]string{"ga.Firewalls.Get,qps,2,10"}); err != nil {
+		t.Errorf("unexpected error from Reload: %v", err)
+	}
+	if _, ok := limiter.rateLimitImpls[cloud.RateLimitKey{Version: meta.VersionGA, Service: "Addresses", Operation: "Get"}]; ok {
+		t.Errorf("Reload should have replaced the old configuration")
+	}
+	if _, ok := limiter.rateLimitImpls[cloud.RateLimitKey{Version: meta.VersionGA, Service: "Firewalls", Operation: "Get"}]; !ok {
+		t.Errorf("Reload should have applied the new configuration")
+	}
+}
+
+// TestReloadConcurrentWithAccept exercises l.mu under -race: Accept must
+// never observe a torn or nil rateLimitImpls while Reload swaps it out from
+// another goroutine.
+func TestReloadConcurrentWithAccept(t *testing.T) {
+	limiter, err := NewGCERateLimiter([]string{"ga.Addresses.Get,qps,1000,1000"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewGCERateLimiter: %v", err)
+	}
+	key := &cloud.RateLimitKey{Version: meta.VersionGA, Service: "Addresses", Operation: "Get"}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := limiter.Accept(context.Background(), key); err != nil {
+				t.Errorf("unexpected error from Accept: %v", err)
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := limiter.Reload([]string{"ga.Addresses.Get,qps,1000,1000"}); err != nil {
+			t.Errorf("unexpected error from Reload: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+// Validate parses each spec in specs independently and returns a slice the
+// same length as specs, where result[i] is nil if specs[i] parsed
+// successfully, or the parse error otherwise. Unlike NewGCERateLimiter, it
+// does not stop at the first invalid spec, so callers can report every
+// problem in a batch of specs in one pass.
+func Validate(specs []string) []error {
+	errs := make([]error, len(specs))
+	for i, spec := range specs {
+		if _, err := parseSpecs([]string{spec}); err != nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
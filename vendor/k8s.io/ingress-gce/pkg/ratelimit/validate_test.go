@@ -0,0 +1,61 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	specs := []string{
+		"ga.Addresses.Get,qps,1.5,5",
+		"gaAddresses.Get,qps,1.5,5",
+		"ga.Addresses.Get,qps,0,5",
+	}
+	errs := Validate(specs)
+	if len(errs) != len(specs) {
+		t.Fatalf("Validate returned %d errors, want %d", len(errs), len(specs))
+	}
+	if errs[0] != nil {
+		t.Errorf("expected no error for %v, got %v", specs[0], errs[0])
+	}
+	if errs[1] == nil {
+		t.Errorf("expected an error for %v", specs[1])
+	}
+	if errs[2] == nil {
+		t.Errorf("expected an error for %v", specs[2])
+	}
+}
+
+func FuzzNewGCERateLimiter(f *testing.F) {
+	for _, seed := range []string{
+		"ga.Addresses.Get,qps,1.5,5",
+		"ga.Addresses.Get,adaptive,1,10,5",
+		"ga.Operations.Get,perProject,2,10",
+		"ga.Addresses.Get,composite,qps:1.5:5,perProject:2:10",
+		"ga.Addresses.Get,qps,1.5,5,class=reconcile,borrow=2",
+		"ga.Addresses.Get,fairclass,1.5,5",
+		"not,a,valid,spec,,,",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, spec string) {
+		// NewGCERateLimiter and Validate must never panic, regardless of
+		// input; a malformed spec should only ever produce an error.
+		specs := []string{spec}
+		NewGCERateLimiter(specs)
+		Validate(specs)
+	})
+}